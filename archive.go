@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archiveMimeTypes are the sniffed content types archive.go knows how to
+// list without extracting to disk.
+var archiveMimeTypes = map[string]bool{
+	"application/zip":   true,
+	"application/x-tar": true,
+	"application/gzip":  true,
+}
+
+var errNotArchive = errors.New("not a supported archive type")
+
+// archiveEntry is one file inside an archive blob, as returned by
+// GET /{id}/files and cached in the blob's sidecar.
+type archiveEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    uint32    `json:"mode"`
+	ModTime time.Time `json:"modtime"`
+}
+
+// splitArchivePath recognizes "{id}/files" and "{id}/files/{index}" and
+// returns the id and the "files" or "files/{index}" remainder.
+func splitArchivePath(path string) (id, rest string, ok bool) {
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || !idRe.MatchString(parts[0]) {
+		return "", "", false
+	}
+	if parts[1] != "files" && !strings.HasPrefix(parts[1], "files/") {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// routeArchive dispatches GET /{id}/files and GET /{id}/files/{index}.
+// rest is the path following the id, e.g. "files" or "files/3".
+func routeArchive(w http.ResponseWriter, r *http.Request, id, rest string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	sc, err := loadSidecar(id)
+	if err != nil {
+		http.Error(w, "sidecar", 500)
+		return
+	}
+	if len(sc.Claims) > 0 && !sc.activeClaims(time.Now()) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if rest == "files" {
+		listArchiveFiles(w, sc, id)
+		return
+	}
+
+	indexStr := strings.TrimPrefix(rest, "files/")
+	index, err := strconv.Atoi(indexStr)
+	if err != nil || index < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	serveArchiveEntry(w, sc, id, index)
+}
+
+func listArchiveFiles(w http.ResponseWriter, sc *sidecar, id string) {
+	entries, err := archiveEntries(sc, id)
+	if errors.Is(err, errNotArchive) {
+		http.Error(w, "not an archive", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, "archive", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// archiveEntries returns sc's archive listing, computing and caching it in
+// the sidecar on first access.
+func archiveEntries(sc *sidecar, id string) ([]archiveEntry, error) {
+	if sc.ArchiveListed {
+		return sc.ArchiveEntries, nil
+	}
+	if !archiveMimeTypes[sc.Mimetype] {
+		return nil, errNotArchive
+	}
+
+	f, size, _, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := f.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	entries, err := readArchiveEntries(sc.Mimetype, f, size)
+	if err != nil {
+		return nil, err
+	}
+
+	sc.ArchiveEntries = entries
+	sc.ArchiveListed = true
+	if err := saveSidecar(id, sc); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func readArchiveEntries(mimetype string, f io.ReadSeeker, size int64) ([]archiveEntry, error) {
+	switch mimetype {
+	case "application/zip":
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			return nil, errors.New("backend reader does not support random access")
+		}
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]archiveEntry, len(zr.File))
+		for i, zf := range zr.File {
+			entries[i] = archiveEntry{
+				Name:    zf.Name,
+				Size:    int64(zf.UncompressedSize64),
+				Mode:    uint32(zf.Mode()),
+				ModTime: zf.Modified,
+			}
+		}
+		return entries, nil
+
+	case "application/x-tar", "application/gzip":
+		tr, err := tarReader(mimetype, f)
+		if err != nil {
+			return nil, err
+		}
+		var entries []archiveEntry
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, archiveEntry{
+				Name:    hdr.Name,
+				Size:    hdr.Size,
+				Mode:    uint32(hdr.Mode),
+				ModTime: hdr.ModTime,
+			})
+		}
+		return entries, nil
+
+	default:
+		return nil, errNotArchive
+	}
+}
+
+func tarReader(mimetype string, f io.Reader) (*tar.Reader, error) {
+	if mimetype == "application/gzip" {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		return tar.NewReader(gz), nil
+	}
+	return tar.NewReader(f), nil
+}
+
+// serveArchiveEntry streams the bytes of the index'th entry in sc's
+// archive listing without ever writing them to disk.
+func serveArchiveEntry(w http.ResponseWriter, sc *sidecar, id string, index int) {
+	if !archiveMimeTypes[sc.Mimetype] {
+		http.Error(w, "not an archive", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	f, size, _, err := store.Get(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if closer, ok := f.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	switch sc.Mimetype {
+	case "application/zip":
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			http.Error(w, "backend reader does not support random access", 500)
+			return
+		}
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			http.Error(w, "archive", 500)
+			return
+		}
+		if index >= len(zr.File) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rc, err := zr.File[index].Open()
+		if err != nil {
+			http.Error(w, "archive", 500)
+			return
+		}
+		defer rc.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, rc)
+
+	case "application/x-tar", "application/gzip":
+		tr, err := tarReader(sc.Mimetype, f)
+		if err != nil {
+			http.Error(w, "archive", 500)
+			return
+		}
+		for i := 0; ; i++ {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, "archive", 500)
+				return
+			}
+			if i != index {
+				continue
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				http.Error(w, "entry is not a regular file", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			io.Copy(w, io.LimitReader(tr, hdr.Size))
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrSidecarNotExist is returned by Backend.GetSidecar when id has no
+// sidecar stored. Like a missing local sidecar file, this is not treated as
+// an error by callers (see metadata.go's loadSidecar): it means the blob
+// predates the sidecar feature or metadata was lost.
+var ErrSidecarNotExist = errors.New("sidecar not found")
+
+// Backend abstracts the durable storage of blobs so upload/serveByID don't
+// need to know whether bytes end up sharded on local disk or in an S3
+// bucket. Ids are content hashes, so Put is expected to be idempotent:
+// putting the same id twice is a no-op success.
+//
+// A blob's sidecar (delete keys, expiry, mimetype, archive-entry cache) is
+// stored through the same Backend as the blob itself, not on whatever local
+// disk happened to handle the request — with BACKEND=s3 that's what lets any
+// replica pointed at the shared bucket serve DELETE/GET/HEAD correctly.
+type Backend interface {
+	// Put stores r under id, replacing any existing object at id.
+	Put(id string, r io.Reader) error
+	// Get returns a seekable reader for id, its size, and its last-modified
+	// time. Callers must Close the returned reader if it implements
+	// io.Closer.
+	Get(id string) (io.ReadSeeker, int64, time.Time, error)
+	// Exists reports whether id is already stored.
+	Exists(id string) (bool, error)
+	// Delete removes id. Deleting a missing id is not an error.
+	Delete(id string) error
+	// Usage returns the total bytes currently stored, excluding config,
+	// temp files, and sidecars.
+	Usage() (int64, error)
+
+	// PutSidecar stores data, the JSON-encoded sidecar, for id.
+	PutSidecar(id string, data []byte) error
+	// GetSidecar returns id's sidecar bytes, or ErrSidecarNotExist if none
+	// is stored.
+	GetSidecar(id string) ([]byte, error)
+	// DeleteSidecar removes id's sidecar. Deleting a missing sidecar is not
+	// an error.
+	DeleteSidecar(id string) error
+}
+
+// newBackend constructs the configured Backend. It never returns a nil
+// Backend on success.
+func newBackend(cfg config) (Backend, error) {
+	switch cfg.Backend {
+	case "s3":
+		return newS3Backend(cfg.S3)
+	case "", "localfs":
+		return newLocalFSBackend(root)
+	default:
+		return nil, fmt.Errorf("unknown BACKEND %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+// Chunked upload protocol, modeled on the GitHub Actions cache upload flow:
+// reserve an upload, PATCH arbitrary byte ranges into a sparse temp file in
+// any order (retries of the same range are safe), then commit to hash and
+// store the assembled file. This lets large uploads survive a flaky
+// connection without restarting from byte zero.
+
+const (
+	defaultChunkSize  = 8 * 1024 * 1024
+	uploadStaleAfter  = 24 * time.Hour
+	uploadJanitorTick = time.Hour
+)
+
+var contentRangeRe = regexp.MustCompile(`^bytes (\d+)-(\d+)/\*$`)
+
+// uploadMeta is the sidecar for a reserved-but-not-yet-committed chunked
+// upload, stored at uploadMetaPath(uploadID).
+type uploadMeta struct {
+	CreatedAt int64 `json:"created_at"`
+}
+
+func uploadsDir() string {
+	return filepath.Join(root, ".uploads")
+}
+
+func uploadPartPath(uploadID string) string {
+	return filepath.Join(uploadsDir(), uploadID+".part")
+}
+
+func uploadMetaPath(uploadID string) string {
+	return filepath.Join(uploadsDir(), uploadID+".json")
+}
+
+// routeUploads dispatches the /uploads, /uploads/{id}, and
+// /uploads/{id}/commit endpoints.
+func routeUploads(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/uploads")
+
+	if rest == "" || rest == "/" {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		reserveUpload(w, r)
+		return
+	}
+
+	rest = strings.TrimPrefix(rest, "/")
+	if strings.HasSuffix(rest, "/commit") {
+		uploadID := strings.TrimSuffix(rest, "/commit")
+		if uploadID == "" || strings.Contains(uploadID, "/") || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		commitUpload(w, r, uploadID)
+		return
+	}
+
+	if strings.Contains(rest, "/") || r.Method != http.MethodPatch {
+		http.NotFound(w, r)
+		return
+	}
+	patchUploadChunk(w, r, rest)
+}
+
+func reserveUpload(w http.ResponseWriter, r *http.Request) {
+	if err := os.MkdirAll(uploadsDir(), 0755); err != nil {
+		http.Error(w, "uploads dir", 500)
+		return
+	}
+
+	uploadID, err := randomToken(32)
+	if err != nil {
+		http.Error(w, "upload id", 500)
+		return
+	}
+
+	part, err := os.Create(uploadPartPath(uploadID))
+	if err != nil {
+		http.Error(w, "reserve", 500)
+		return
+	}
+	part.Close()
+
+	meta := uploadMeta{CreatedAt: time.Now().Unix()}
+	buf, _ := json.Marshal(meta)
+	if err := os.WriteFile(uploadMetaPath(uploadID), buf, 0644); err != nil {
+		http.Error(w, "reserve", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"upload_id": uploadID, "chunk_size": defaultChunkSize})
+}
+
+func patchUploadChunk(w http.ResponseWriter, r *http.Request, uploadID string) {
+	if _, err := os.Stat(uploadMetaPath(uploadID)); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	m := contentRangeRe.FindStringSubmatch(r.Header.Get("Content-Range"))
+	if m == nil {
+		http.Error(w, "Content-Range must be \"bytes X-Y/*\"", http.StatusBadRequest)
+		return
+	}
+	start, err1 := strconv.ParseInt(m[1], 10, 64)
+	end, err2 := strconv.ParseInt(m[2], 10, 64)
+	if err1 != nil || err2 != nil || end < start {
+		http.Error(w, "invalid Content-Range", http.StatusBadRequest)
+		return
+	}
+	want := end - start + 1
+	// Bound both the chunk size and how far into the file it writes before
+	// allocating or seeking anything: an unbounded Content-Range (e.g.
+	// "bytes 0-9223372036854775806/*") must not be trusted to size a buffer
+	// or a sparse-file offset.
+	if want > defaultChunkSize {
+		http.Error(w, "chunk exceeds chunk_size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if end >= cfg.MaxUploadByte {
+		http.Error(w, "range exceeds MAX_UPLOAD_GB", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	part, err := os.OpenFile(uploadPartPath(uploadID), os.O_WRONLY, 0644)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer part.Close()
+
+	r.Body = http.MaxBytesReader(w, r.Body, want)
+	written, err := io.Copy(&offsetWriter{f: part, off: start}, r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, "chunk exceeds declared range", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "write", 500)
+		return
+	}
+	if written != want {
+		http.Error(w, "short chunk body", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// offsetWriter is an io.Writer that writes through to f at a position
+// advancing from off, letting io.Copy stream a chunk straight into its
+// range of the sparse part file without buffering it in memory first.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.f.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+func commitUpload(w http.ResponseWriter, r *http.Request, uploadID string) {
+	partPath := uploadPartPath(uploadID)
+	metaPath := uploadMetaPath(uploadID)
+	if _, err := os.Stat(metaPath); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	part, err := os.Open(partPath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer part.Close()
+
+	now := time.Now()
+	expiryUnix, err := parseExpiry(r.Header.Get("X-File-Expiry"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h3 := blake3.New()
+	h256 := sha256.New()
+	sniff := &headerSniffer{}
+	n, err := io.Copy(io.MultiWriter(h3, h256, sniff), part)
+	if err != nil {
+		http.Error(w, "hash", 500)
+		return
+	}
+	if n > cfg.MaxUploadByte {
+		http.Error(w, "upload exceeds MAX_UPLOAD_GB", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	detectedType := sniffContentType(sniff.buf)
+	if isForbidden(detectedType, cfg.ForbiddenTypes) {
+		http.Error(w, "file type "+detectedType+" is not allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(h3.Sum(nil))
+	deleteKey, err := newDeleteKey()
+	if err != nil {
+		http.Error(w, "delete key", 500)
+		return
+	}
+	newClaim := claim{DeleteKey: deleteKey, UploadedAt: now.Unix(), ExpiryUnix: expiryUnix}
+
+	quotaMu.Lock()
+
+	exists, err := store.Exists(id)
+	if err != nil {
+		quotaMu.Unlock()
+		http.Error(w, "exists", 500)
+		return
+	}
+	if exists {
+		sc, err := loadSidecar(id)
+		if err != nil {
+			quotaMu.Unlock()
+			http.Error(w, "sidecar", 500)
+			return
+		}
+		sc.Claims = append(sc.Claims, newClaim)
+		err = saveSidecar(id, sc)
+		quotaMu.Unlock()
+		if err != nil {
+			http.Error(w, "sidecar", 500)
+			return
+		}
+		removeUploadFiles(uploadID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"id": id, "size": n, "deduped": true, "delete_key": deleteKey})
+		return
+	}
+
+	used, err := store.Usage()
+	if err != nil {
+		quotaMu.Unlock()
+		http.Error(w, "usage", 500)
+		return
+	}
+	if used+pendingBytes+n > cfg.MaxStorageByte {
+		quotaMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInsufficientStorage)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error":             "root storage limit exceeded",
+			"used_bytes":        used,
+			"max_storage_bytes": cfg.MaxStorageByte,
+		})
+		return
+	}
+	pendingBytes += n
+	quotaMu.Unlock()
+
+	// store.Put (a real S3 network transfer when BACKEND=s3) runs without
+	// quotaMu held, same as the single-file upload path, so one commit
+	// doesn't serialize every other upload on the server behind its PUT.
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		quotaMu.Lock()
+		pendingBytes -= n
+		quotaMu.Unlock()
+		http.Error(w, "seek", 500)
+		return
+	}
+	putErr := store.Put(id, part)
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	pendingBytes -= n
+	if putErr != nil {
+		http.Error(w, "put", 500)
+		return
+	}
+
+	sc, err := loadSidecar(id)
+	if err != nil {
+		http.Error(w, "sidecar", 500)
+		return
+	}
+	if sc.SHA256 == "" {
+		sc.SHA256 = hex.EncodeToString(h256.Sum(nil))
+		sc.BLAKE3 = id
+		sc.Size = n
+		sc.Mimetype = detectedType
+	}
+	sc.Claims = append(sc.Claims, newClaim)
+	if err := saveSidecar(id, sc); err != nil {
+		http.Error(w, "sidecar", 500)
+		return
+	}
+
+	removeUploadFiles(uploadID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "size": n, "deduped": false, "delete_key": deleteKey})
+}
+
+func removeUploadFiles(uploadID string) {
+	_ = os.Remove(uploadPartPath(uploadID))
+	_ = os.Remove(uploadMetaPath(uploadID))
+}
+
+// uploadJanitor periodically removes partial uploads that were reserved
+// but never committed, so an abandoned client can't leak disk space
+// forever. It runs for the lifetime of the process.
+func uploadJanitor() {
+	ticker := time.NewTicker(uploadJanitorTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepStaleUploads()
+	}
+}
+
+func sweepStaleUploads() {
+	entries, err := os.ReadDir(uploadsDir())
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().Add(-uploadStaleAfter).Unix()
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		uploadID := strings.TrimSuffix(e.Name(), ".json")
+		buf, err := os.ReadFile(uploadMetaPath(uploadID))
+		if err != nil {
+			continue
+		}
+		var m uploadMeta
+		if err := json.Unmarshal(buf, &m); err != nil {
+			continue
+		}
+		if m.CreatedAt <= cutoff {
+			log.Printf("sht2: expiring stale upload %s", uploadID)
+			removeUploadFiles(uploadID)
+		}
+	}
+}
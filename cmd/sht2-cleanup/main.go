@@ -0,0 +1,102 @@
+// Command sht2-cleanup walks an sht2 BLOB_PATH tree and removes blobs whose
+// sidecar metadata shows no remaining unexpired claims. It's meant to run
+// periodically (cron, a systemd timer) alongside the server, since sht2
+// itself only hides expired blobs from serveByID rather than reclaiming
+// their disk space. It only supports the localfs backend: with BACKEND=s3,
+// blobs and sidecars live in the bucket (see backend.go's
+// PutSidecar/GetSidecar), not under BLOB_PATH.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// claim and sidecar mirror the JSON shape the server writes next to each
+// blob (localFSBackend.PutSidecar). Only the fields cleanup needs to make a
+// decision are read here.
+type claim struct {
+	ExpiryUnix int64 `json:"expiry_unix,omitempty"`
+}
+
+type sidecar struct {
+	Claims []claim `json:"claims"`
+}
+
+func (s sidecar) expired(now time.Time) bool {
+	if len(s.Claims) == 0 {
+		return false
+	}
+	for _, c := range s.Claims {
+		if c.ExpiryUnix == 0 || now.Unix() < c.ExpiryUnix {
+			return false
+		}
+	}
+	return true
+}
+
+func main() {
+	root := flag.String("root", os.Getenv("BLOB_PATH"), "blob storage root (defaults to $BLOB_PATH)")
+	dryRun := flag.Bool("dry-run", false, "log what would be removed without deleting anything")
+	flag.Parse()
+
+	if *root == "" {
+		log.Fatal("sht2-cleanup: -root or BLOB_PATH must be set")
+	}
+
+	now := time.Now()
+	var removed, scanned int
+
+	err := filepath.WalkDir(*root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		scanned++
+
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("sht2-cleanup: read %s: %v", path, err)
+			return nil
+		}
+		var sc sidecar
+		if err := json.Unmarshal(buf, &sc); err != nil {
+			log.Printf("sht2-cleanup: parse %s: %v", path, err)
+			return nil
+		}
+		if !sc.expired(now) {
+			return nil
+		}
+
+		blobPath := strings.TrimSuffix(path, ".json")
+		if *dryRun {
+			log.Printf("sht2-cleanup: would remove expired blob %s", blobPath)
+			removed++
+			return nil
+		}
+
+		if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("sht2-cleanup: remove %s: %v", blobPath, err)
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("sht2-cleanup: remove %s: %v", path, err)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("sht2-cleanup: walk %s: %v", *root, err)
+	}
+
+	log.Printf("sht2-cleanup: scanned %d sidecars, removed %d expired blobs", scanned, removed)
+}
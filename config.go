@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// config holds the quota and storage-backend settings read from the
+// .sht2 file (and, for S3, a handful of supporting env vars).
+type config struct {
+	MaxStorageGB   float64
+	MaxUploadGB    float64
+	MaxStorageByte int64
+	MaxUploadByte  int64
+
+	Backend string
+	S3      s3Config
+
+	// PomfPath is the path a pomf/ShareX/uguu-compatible client POSTs
+	// multipart batches to.
+	PomfPath string
+
+	// ForbiddenTypes are sniffed MIME types rejected at upload time (see
+	// sniffContentType), e.g. "application/x-dosexec".
+	ForbiddenTypes []string
+}
+
+func (c config) backendName() string {
+	if c.Backend == "" {
+		return "localfs"
+	}
+	return c.Backend
+}
+
+func defaultConfig() config {
+	return config{
+		MaxStorageGB:   20,
+		MaxUploadGB:    2,
+		MaxStorageByte: 20 * gib,
+		MaxUploadByte:  2 * gib,
+		Backend:        "localfs",
+		PomfPath:       "/upload.php",
+	}
+}
+
+func writeDefaultConfig(path string, cfg config) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f,
+		"# sht2 storage configuration (values are in GiB)\nMAX_STORAGE_GB=%.0f\nMAX_UPLOAD_GB=%.0f\n\n# BACKEND=localfs (default) or s3. S3 connection details are read from the\n# environment: S3_ENDPOINT, S3_BUCKET, S3_REGION, S3_ACCESS_KEY, S3_SECRET_KEY.\nBACKEND=%s\n\n# Path for pomf/ShareX/uguu-compatible batch uploads.\nPOMF_PATH=%s\n\n# Comma-separated sniffed MIME types to reject at upload time, e.g.\n# FORBIDDEN_TYPES=application/x-dosexec,application/x-msdownload\nFORBIDDEN_TYPES=\n",
+		cfg.MaxStorageGB, cfg.MaxUploadGB, cfg.backendName(), cfg.PomfPath,
+	)
+	return err
+}
+
+// loadConfig reads quota and backend settings from the .sht2 file under
+// root, writing a default file on first run. S3 connection details are
+// read from the environment rather than the file since they're usually
+// host-specific secrets.
+func loadConfig() (config, error) {
+	cfg := defaultConfig()
+	path := filepath.Join(root, cfgPath)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := writeDefaultConfig(path, cfg); err != nil {
+			return cfg, err
+		}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return cfg, err
+		}
+		defer f.Close()
+
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			key := strings.TrimSpace(parts[0])
+			val := strings.TrimSpace(parts[1])
+
+			switch key {
+			case "MAX_STORAGE_GB", "MAX_UPLOAD_GB":
+				gb, err := strconv.ParseFloat(val, 64)
+				if err != nil || gb <= 0 {
+					return cfg, fmt.Errorf("invalid %s in %s", key, path)
+				}
+				if key == "MAX_STORAGE_GB" {
+					cfg.MaxStorageGB = gb
+					cfg.MaxStorageByte = int64(gb * float64(gib))
+				} else {
+					cfg.MaxUploadGB = gb
+					cfg.MaxUploadByte = int64(gb * float64(gib))
+				}
+			case "BACKEND":
+				cfg.Backend = val
+			case "POMF_PATH":
+				cfg.PomfPath = val
+			case "FORBIDDEN_TYPES":
+				cfg.ForbiddenTypes = nil
+				for _, t := range strings.Split(val, ",") {
+					if t = strings.TrimSpace(t); t != "" {
+						cfg.ForbiddenTypes = append(cfg.ForbiddenTypes, t)
+					}
+				}
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return cfg, err
+		}
+	}
+
+	cfg.S3 = s3Config{
+		Endpoint:  getenv("S3_ENDPOINT", ""),
+		Bucket:    getenv("S3_BUCKET", ""),
+		Region:    getenv("S3_REGION", "us-east-1"),
+		AccessKey: getenv("S3_ACCESS_KEY", ""),
+		SecretKey: getenv("S3_SECRET_KEY", ""),
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// localFSBackend stores blobs on local disk under a two-level shard layout
+// (see path), writing through a temp file + rename so a reader never
+// observes a partially written object. Sidecars are written the same way,
+// next to their blob.
+type localFSBackend struct {
+	root string
+}
+
+func newLocalFSBackend(root string) (*localFSBackend, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &localFSBackend{root: root}, nil
+}
+
+func (b *localFSBackend) path(id string) string {
+	return filepath.Join(b.root, id[:2], id[2:4], id)
+}
+
+func (b *localFSBackend) sidecarPath(id string) string {
+	return b.path(id) + ".json"
+}
+
+func (b *localFSBackend) Put(id string, r io.Reader) error {
+	final := b.path(id)
+	if err := os.MkdirAll(filepath.Dir(final), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(final), "put-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, final)
+}
+
+func (b *localFSBackend) Get(id string) (io.ReadSeeker, int64, time.Time, error) {
+	f, err := os.Open(b.path(id))
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, time.Time{}, err
+	}
+	return f, st.Size(), st.ModTime(), nil
+}
+
+func (b *localFSBackend) Exists(id string) (bool, error) {
+	_, err := os.Stat(b.path(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *localFSBackend) Delete(id string) error {
+	err := os.Remove(b.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// PutSidecar writes data atomically (temp file + rename) next to its blob.
+func (b *localFSBackend) PutSidecar(id string, data []byte) error {
+	path := b.sidecarPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "sidecar-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+func (b *localFSBackend) GetSidecar(id string) ([]byte, error) {
+	buf, err := os.ReadFile(b.sidecarPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrSidecarNotExist
+	}
+	return buf, err
+}
+
+func (b *localFSBackend) DeleteSidecar(id string) error {
+	err := os.Remove(b.sidecarPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Usage sums blob bytes under root, skipping the .sht2 config file, dotfile
+// directories like .tmp (in-flight uploads), and the per-blob .json sidecar
+// files, none of which count against the storage quota.
+func (b *localFSBackend) Usage() (int64, error) {
+	var total int64
+	err := filepath.WalkDir(b.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != b.root && strings.HasPrefix(d.Name(), ".") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || strings.HasSuffix(d.Name(), ".json") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	return total, err
+}
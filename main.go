@@ -1,21 +1,23 @@
 package main
 
 import (
-	"bufio"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/zeebo/blake3"
@@ -28,16 +30,17 @@ var (
 	cfgPath = ".sht2"
 
 	quotaMu sync.Mutex
-	limits  quotaConfig
+	// pendingBytes is the size of uploads that have passed their quota check
+	// under quotaMu but whose store.Put (the actual transfer, which for the
+	// s3 backend is a real network call and must not run with quotaMu held)
+	// hasn't finished yet. Counting it alongside store.Usage() keeps two
+	// concurrent uploads from both passing the check for space only one of
+	// them actually has.
+	pendingBytes int64
+	cfg          config
+	store        Backend
 )
 
-type quotaConfig struct {
-	MaxStorageGB   float64
-	MaxUploadGB    float64
-	MaxStorageByte int64
-	MaxUploadByte  int64
-}
-
 const gib = int64(1024 * 1024 * 1024)
 
 func getenv(k, d string) string {
@@ -48,106 +51,18 @@ func getenv(k, d string) string {
 	return v
 }
 
-func objPath(id string) string {
-	return filepath.Join(root, id[:2], id[2:4], id)
-}
-
-func defaultQuotaConfig() quotaConfig {
-	return quotaConfig{
-		MaxStorageGB:   20,
-		MaxUploadGB:    2,
-		MaxStorageByte: 20 * gib,
-		MaxUploadByte:  2 * gib,
-	}
-}
-
-func writeDefaultConfig(path string, cfg quotaConfig) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	_, err = fmt.Fprintf(f,
-		"# sht2 storage configuration (values are in GiB)\nMAX_STORAGE_GB=%.0f\nMAX_UPLOAD_GB=%.0f\n",
-		cfg.MaxStorageGB, cfg.MaxUploadGB,
-	)
-	return err
-}
-
-func loadQuotaConfig() (quotaConfig, error) {
-	cfg := defaultQuotaConfig()
-	path := filepath.Join(root, cfgPath)
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		if err := writeDefaultConfig(path, cfg); err != nil {
-			return cfg, err
-		}
-		return cfg, nil
-	}
-
-	f, err := os.Open(path)
-	if err != nil {
-		return cfg, err
-	}
-	defer f.Close()
-
-	sc := bufio.NewScanner(f)
-	for sc.Scan() {
-		line := strings.TrimSpace(sc.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		key := strings.TrimSpace(parts[0])
-		val := strings.TrimSpace(parts[1])
-		gb, err := strconv.ParseFloat(val, 64)
-		if err != nil || gb <= 0 {
-			return cfg, fmt.Errorf("invalid %s in %s", key, path)
-		}
-		switch key {
-		case "MAX_STORAGE_GB":
-			cfg.MaxStorageGB = gb
-			cfg.MaxStorageByte = int64(gb * float64(gib))
-		case "MAX_UPLOAD_GB":
-			cfg.MaxUploadGB = gb
-			cfg.MaxUploadByte = int64(gb * float64(gib))
-		}
-	}
-	if err := sc.Err(); err != nil {
-		return cfg, err
-	}
-	return cfg, nil
-}
-
-func diskUsageBytes(exclude string) (int64, error) {
-	var total int64
-	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
-		if path == exclude || filepath.Base(path) == cfgPath {
-			return nil
-		}
-		info, err := d.Info()
-		if err != nil {
-			return err
-		}
-		total += info.Size()
-		return nil
-	})
-	return total, err
+func tmpDir() string {
+	return filepath.Join(root, ".tmp")
 }
 
 func upload(w http.ResponseWriter, r *http.Request) {
-	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxUploadByte)
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadByte)
 
-	tmp, err := os.CreateTemp(root, "up-*")
+	if err := os.MkdirAll(tmpDir(), 0755); err != nil {
+		http.Error(w, "tmp", 500)
+		return
+	}
+	tmp, err := os.CreateTemp(tmpDir(), "up-*")
 	if err != nil {
 		http.Error(w, "tmp", 500)
 		return
@@ -156,9 +71,9 @@ func upload(w http.ResponseWriter, r *http.Request) {
 	defer os.Remove(tmpName)
 
 	src := io.Reader(r.Body)
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "" {
-		mediaType, _, err := mime.ParseMediaType(contentType)
+	fileContentType := r.Header.Get("Content-Type")
+	if fileContentType != "" {
+		mediaType, _, err := mime.ParseMediaType(fileContentType)
 		if err != nil {
 			http.Error(w, "invalid content-type", http.StatusBadRequest)
 			return
@@ -170,7 +85,7 @@ func upload(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
-			var filePart io.ReadCloser
+			var filePart *multipart.Part
 			for {
 				part, err := mr.NextPart()
 				if err == io.EOF {
@@ -197,8 +112,17 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	h := blake3.New()
-	n, err := io.Copy(io.MultiWriter(tmp, h), src)
+	now := time.Now()
+	expiryUnix, err := parseExpiry(r.Header.Get("X-File-Expiry"), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h3 := blake3.New()
+	h256 := sha256.New()
+	sniff := &headerSniffer{}
+	n, err := io.Copy(io.MultiWriter(tmp, h3, h256, sniff), src)
 	if err != nil {
 		var maxErr *http.MaxBytesError
 		if errors.As(err, &maxErr) {
@@ -213,71 +137,181 @@ func upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id := base64.RawURLEncoding.EncodeToString(h.Sum(nil))
-	final := objPath(id)
+	detectedType := sniffContentType(sniff.buf)
+	if isForbidden(detectedType, cfg.ForbiddenTypes) {
+		http.Error(w, "file type "+detectedType+" is not allowed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(h3.Sum(nil))
 
-	if err := os.MkdirAll(filepath.Dir(final), 0755); err != nil {
-		http.Error(w, "mkdir", 500)
+	deleteKey, err := newDeleteKey()
+	if err != nil {
+		http.Error(w, "delete key", 500)
 		return
 	}
+	newClaim := claim{DeleteKey: deleteKey, UploadedAt: now.Unix(), ExpiryUnix: expiryUnix}
 
 	quotaMu.Lock()
-	defer quotaMu.Unlock()
 
-	if _, err := os.Stat(final); err == nil {
+	exists, err := store.Exists(id)
+	if err != nil {
+		quotaMu.Unlock()
+		http.Error(w, "exists", 500)
+		return
+	}
+	if exists {
+		sc, err := loadSidecar(id)
+		if err != nil {
+			quotaMu.Unlock()
+			http.Error(w, "sidecar", 500)
+			return
+		}
+		sc.Claims = append(sc.Claims, newClaim)
+		err = saveSidecar(id, sc)
+		quotaMu.Unlock()
+		if err != nil {
+			http.Error(w, "sidecar", 500)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{"id": id, "size": n, "deduped": true})
+		json.NewEncoder(w).Encode(map[string]any{"id": id, "size": n, "deduped": true, "delete_key": deleteKey})
 		return
 	}
 
-	used, err := diskUsageBytes(tmpName)
+	used, err := store.Usage()
 	if err != nil {
+		quotaMu.Unlock()
 		http.Error(w, "usage", 500)
 		return
 	}
-	if used+n > limits.MaxStorageByte {
+	if used+pendingBytes+n > cfg.MaxStorageByte {
+		quotaMu.Unlock()
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInsufficientStorage)
 		_ = json.NewEncoder(w).Encode(map[string]any{
 			"error":             "root storage limit exceeded",
 			"used_bytes":        used,
-			"max_storage_bytes": limits.MaxStorageByte,
+			"max_storage_bytes": cfg.MaxStorageByte,
 		})
 		return
 	}
+	pendingBytes += n
+	quotaMu.Unlock()
+
+	// The transfer itself (a real network round trip for the s3 backend)
+	// runs without quotaMu held, so it doesn't serialize every upload on
+	// this server behind one at a time; pendingBytes above is what keeps a
+	// second concurrent upload from over-committing the quota in the
+	// meantime.
+	src2, err := os.Open(tmpName)
+	if err != nil {
+		quotaMu.Lock()
+		pendingBytes -= n
+		quotaMu.Unlock()
+		http.Error(w, "reopen", 500)
+		return
+	}
+	putErr := store.Put(id, src2)
+	src2.Close()
 
-	if err := os.Rename(tmpName, final); err != nil {
-		http.Error(w, "rename", 500)
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	pendingBytes -= n
+	if putErr != nil {
+		http.Error(w, "put", 500)
+		return
+	}
+
+	// Reload rather than construct from scratch: a concurrent upload of the
+	// same bytes may have finished first and already created this sidecar,
+	// in which case we only need to add our claim to it.
+	sc, err := loadSidecar(id)
+	if err != nil {
+		http.Error(w, "sidecar", 500)
+		return
+	}
+	if sc.SHA256 == "" {
+		sc.SHA256 = hex.EncodeToString(h256.Sum(nil))
+		sc.BLAKE3 = id
+		sc.Size = n
+		sc.Mimetype = detectedType
+	}
+	sc.Claims = append(sc.Claims, newClaim)
+	if err := saveSidecar(id, sc); err != nil {
+		http.Error(w, "sidecar", 500)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{"id": id, "size": n, "deduped": false})
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "size": n, "deduped": false, "delete_key": deleteKey})
+}
+
+func deleteByID(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/")
+	if id == "" || strings.Contains(id, "/") || !idRe.MatchString(id) {
+		http.NotFound(w, r)
+		return
+	}
+	deleteKey := r.Header.Get("X-Delete-Key")
+	if deleteKey == "" {
+		http.Error(w, "missing X-Delete-Key", http.StatusBadRequest)
+		return
+	}
+
+	quotaMu.Lock()
+	found, err := removeClaim(id, deleteKey)
+	quotaMu.Unlock()
+	if err != nil {
+		http.Error(w, "delete", 500)
+		return
+	}
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
+// serveByID handles GET /{id}. Because id is a content hash, the blob it
+// names can never change, so the ETag derived from id alone is a strong
+// validator forever: If-Match/If-None-Match/If-Range comparisons against it
+// (handled by http.ServeContent, using the ETag and Content-Type header set
+// below) and the immutable Cache-Control are always safe, no staleness
+// window required.
 func serveByID(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/")
 	if id == "" || strings.Contains(id, "/") || !idRe.MatchString(id) {
 		http.NotFound(w, r)
 		return
 	}
-	p := objPath(id)
 
-	f, err := os.Open(p)
+	sc, err := loadSidecar(id)
 	if err != nil {
+		http.Error(w, "sidecar", 500)
+		return
+	}
+	if len(sc.Claims) > 0 && !sc.activeClaims(time.Now()) {
 		http.NotFound(w, r)
 		return
 	}
-	defer f.Close()
 
-	st, err := f.Stat()
+	f, _, modTime, err := store.Get(id)
 	if err != nil {
-		http.Error(w, "stat", 500)
+		http.NotFound(w, r)
 		return
 	}
+	if closer, ok := f.(io.Closer); ok {
+		defer closer.Close()
+	}
 
-	w.Header().Set("ETag", `"`+id+`"`)
-	http.ServeContent(w, r, id, st.ModTime(), f)
+	if sc.Mimetype != "" {
+		w.Header().Set("Content-Type", sc.Mimetype)
+	}
+	w.Header().Set("ETag", blobETag(id))
+	w.Header().Set("Cache-Control", immutableCacheControl)
+	http.ServeContent(w, r, id, modTime, f)
 }
 
 func setCORS(w http.ResponseWriter, r *http.Request) {
@@ -292,7 +326,7 @@ func setCORS(w http.ResponseWriter, r *http.Request) {
 	// Safer: reflect exact origin (works with credentials too)
 	w.Header().Set("Vary", "Origin, Access-Control-Request-Headers, Access-Control-Request-Method")
 	w.Header().Set("Access-Control-Allow-Origin", origin)
-	w.Header().Set("Access-Control-Allow-Methods", "POST, PUT, GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, PUT, PATCH, GET, HEAD, DELETE, OPTIONS")
 	reqHeaders := r.Header.Get("Access-Control-Request-Headers")
 	if reqHeaders != "" {
 		w.Header().Set("Access-Control-Allow-Headers", reqHeaders)
@@ -312,11 +346,18 @@ func main() {
 	port := getenv("PORT", "8080")
 
 	_ = os.MkdirAll(root, 0755)
-	cfg, err := loadQuotaConfig()
+	loaded, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg = loaded
+
+	store, err = newBackend(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
-	limits = cfg
+
+	go uploadJanitor()
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		setCORS(w, r)
@@ -335,15 +376,44 @@ func main() {
 			return
 		}
 
-		if r.Method == "GET" || r.Method == "HEAD" {
+		if r.URL.Path == "/uploads" || strings.HasPrefix(r.URL.Path, "/uploads/") {
+			routeUploads(w, r)
+			return
+		}
+
+		if r.URL.Path == cfg.PomfPath {
+			if r.Method != "POST" {
+				w.WriteHeader(405)
+				return
+			}
+			pomfUpload(w, r)
+			return
+		}
+
+		if id, rest, ok := splitArchivePath(strings.TrimPrefix(r.URL.Path, "/")); ok {
+			routeArchive(w, r, id, rest)
+			return
+		}
+
+		if r.Method == "HEAD" {
+			headByID(w, r, strings.TrimPrefix(r.URL.Path, "/"))
+			return
+		}
+
+		if r.Method == "GET" {
 			serveByID(w, r)
 			return
 		}
 
+		if r.Method == "DELETE" {
+			deleteByID(w, r)
+			return
+		}
+
 		w.WriteHeader(405)
 	})
 
-	fmt.Printf("listening on :%s (max_storage=%.2fGiB max_upload=%.2fGiB)\n", port, limits.MaxStorageGB, limits.MaxUploadGB)
+	fmt.Printf("listening on :%s (backend=%s max_storage=%.2fGiB max_upload=%.2fGiB)\n", port, cfg.backendName(), cfg.MaxStorageGB, cfg.MaxUploadGB)
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// claim represents one "reason a blob should still exist": whoever uploaded
+// it got back a delete_key and, optionally, an expiry. Because ids are
+// content hashes, the same bytes uploaded by two different callers share
+// one blob but must not let either caller's deletion or expiry affect the
+// other's claim.
+type claim struct {
+	DeleteKey  string `json:"delete_key"`
+	UploadedAt int64  `json:"uploaded_at"`
+	ExpiryUnix int64  `json:"expiry_unix,omitempty"` // 0 = never expires
+}
+
+func (c claim) expired(now time.Time) bool {
+	return c.ExpiryUnix != 0 && now.Unix() >= c.ExpiryUnix
+}
+
+// sidecar is the JSON metadata stored alongside each blob through the
+// configured Backend's PutSidecar/GetSidecar (see backend.go).
+type sidecar struct {
+	SHA256   string  `json:"sha256"`
+	BLAKE3   string  `json:"blake3"`
+	Size     int64   `json:"size"`
+	Mimetype string  `json:"mimetype,omitempty"`
+	Claims   []claim `json:"claims"`
+
+	// ArchiveEntries caches the result of listing an archive blob's
+	// contents (see archive.go) so repeat listings are O(1). ArchiveListed
+	// distinguishes "not yet listed" from "listed, empty archive".
+	ArchiveListed  bool           `json:"archive_listed,omitempty"`
+	ArchiveEntries []archiveEntry `json:"archive_entries,omitempty"`
+}
+
+// activeClaims reports whether the sidecar has at least one claim that
+// hasn't expired.
+func (s *sidecar) activeClaims(now time.Time) bool {
+	for _, c := range s.Claims {
+		if !c.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSidecar reads the sidecar for id through the configured Backend, so
+// it always sees the same metadata regardless of which replica handled the
+// upload. A missing sidecar is not an error: it means the blob predates
+// this feature (or metadata was lost), so callers should treat it as having
+// no expiry and no deletable claims.
+func loadSidecar(id string) (*sidecar, error) {
+	buf, err := store.GetSidecar(id)
+	if errors.Is(err, ErrSidecarNotExist) {
+		return &sidecar{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s sidecar
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// saveSidecar stores s through the configured Backend, alongside its blob.
+func saveSidecar(id string, s *sidecar) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return store.PutSidecar(id, buf)
+}
+
+func deleteSidecar(id string) error {
+	return store.DeleteSidecar(id)
+}
+
+// removeClaim deletes the claim matching deleteKey from id's sidecar,
+// deleting the blob itself (and its sidecar) if that was the last
+// remaining claim. It reports whether a matching claim was found. Callers
+// must hold quotaMu.
+func removeClaim(id, deleteKey string) (bool, error) {
+	sc, err := loadSidecar(id)
+	if err != nil {
+		return false, err
+	}
+
+	kept := sc.Claims[:0]
+	found := false
+	for _, c := range sc.Claims {
+		if c.DeleteKey == deleteKey {
+			found = true
+			continue
+		}
+		kept = append(kept, c)
+	}
+	if !found {
+		return false, nil
+	}
+	sc.Claims = kept
+
+	if len(sc.Claims) == 0 {
+		if err := store.Delete(id); err != nil {
+			return true, err
+		}
+		return true, deleteSidecar(id)
+	}
+	return true, saveSidecar(id, sc)
+}
+
+// randomToken returns a random URL-safe token with n bytes of entropy.
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// newDeleteKey returns a random URL-safe token handed back to uploaders so
+// they can later delete their claim on a blob.
+func newDeleteKey() (string, error) {
+	return randomToken(32)
+}
+
+// parseExpiry interprets the X-File-Expiry header, which is either a
+// relative duration in seconds ("3600") or an absolute RFC3339 timestamp
+// ("2026-08-01T00:00:00Z"). An empty header means no expiry.
+func parseExpiry(header string, now time.Time) (int64, error) {
+	if header == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if secs <= 0 {
+			return 0, fmt.Errorf("X-File-Expiry must be positive")
+		}
+		return now.Add(time.Duration(secs) * time.Second).Unix(), nil
+	}
+	t, err := time.Parse(time.RFC3339, header)
+	if err != nil {
+		return 0, fmt.Errorf("invalid X-File-Expiry: %w", err)
+	}
+	return t.Unix(), nil
+}
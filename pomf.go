@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+// maxPomfBatchFiles bounds how many files[] parts a single batch request
+// may contain, so a client can't force the server to buffer an unbounded
+// number of near-MaxUploadByte temp files into .tmp before any per-file
+// quota check runs.
+const maxPomfBatchFiles = 128
+
+// pomfFile is one buffered-to-disk part of a pomf batch upload, already
+// hashed while it was being read off the wire.
+type pomfFile struct {
+	name     string
+	tmpPath  string
+	id       string
+	sha256   string
+	mimetype string
+	size     int64
+}
+
+type pomfFileResult struct {
+	URL  string `json:"url"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	Name string `json:"name"`
+}
+
+func pomfError(w http.ResponseWriter, status, errorcode int, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"success":     false,
+		"errorcode":   errorcode,
+		"description": description,
+	})
+}
+
+// pomfUpload implements the pomf-standard POST /upload.php batch endpoint:
+// multipart/form-data with repeated files[] parts, pomf-shaped JSON back.
+// Existing clients (ShareX, uguu, pomf-uploader) work against sht2 without
+// changes to their request format.
+func pomfUpload(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		pomfError(w, http.StatusBadRequest, 0, "expected multipart/form-data")
+		return
+	}
+
+	var files []pomfFile
+
+	if err := os.MkdirAll(tmpDir(), 0755); err != nil {
+		pomfError(w, http.StatusInternalServerError, 3, "server error")
+		return
+	}
+
+	// usedAtStart plus the running total of files buffered so far bounds how
+	// much gets written into .tmp before we refuse the batch outright — a
+	// client can't force hundreds of near-MaxUploadByte files to disk before
+	// any quota check runs. commitPomfFile still does the authoritative,
+	// lock-held check per file since usage can shift between here and then.
+	usedAtStart, err := store.Usage()
+	if err != nil {
+		pomfError(w, http.StatusInternalServerError, 3, "server error")
+		return
+	}
+	var totalSize int64
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pomfError(w, http.StatusBadRequest, 0, "invalid multipart body")
+			return
+		}
+		if part.FormName() != "files[]" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		if len(files) >= maxPomfBatchFiles {
+			part.Close()
+			pomfError(w, http.StatusRequestEntityTooLarge, 1, "batch exceeds the maximum of 128 files")
+			return
+		}
+
+		tmp, err := os.CreateTemp(tmpDir(), "pomf-*")
+		if err != nil {
+			part.Close()
+			pomfError(w, http.StatusInternalServerError, 3, "server error")
+			return
+		}
+		// Deferred here, before any of the checks below can return early, so
+		// every part written to .tmp gets swept on the way out regardless of
+		// which check rejects it — not just the ones that make it into files.
+		defer os.Remove(tmp.Name())
+
+		h3 := blake3.New()
+		h256 := sha256.New()
+		sniff := &headerSniffer{}
+		n, err := io.Copy(io.MultiWriter(tmp, h3, h256, sniff), io.LimitReader(part, cfg.MaxUploadByte+1))
+		name := part.FileName()
+		part.Close()
+		tmp.Close()
+		if err != nil {
+			pomfError(w, http.StatusInternalServerError, 3, "server error")
+			return
+		}
+		if n > cfg.MaxUploadByte {
+			pomfError(w, http.StatusRequestEntityTooLarge, 1, name+" exceeds MAX_UPLOAD_GB")
+			return
+		}
+		if detected := sniffContentType(sniff.buf); isForbidden(detected, cfg.ForbiddenTypes) {
+			pomfError(w, http.StatusUnsupportedMediaType, 1, name+" is type "+detected+", which is not allowed")
+			return
+		}
+
+		totalSize += n
+		if usedAtStart+totalSize > cfg.MaxStorageByte {
+			pomfError(w, http.StatusInsufficientStorage, 2, "batch exceeds root storage limit")
+			return
+		}
+
+		files = append(files, pomfFile{
+			name:     name,
+			tmpPath:  tmp.Name(),
+			id:       base64.RawURLEncoding.EncodeToString(h3.Sum(nil)),
+			sha256:   hex.EncodeToString(h256.Sum(nil)),
+			mimetype: sniffContentType(sniff.buf),
+			size:     n,
+		})
+	}
+
+	if len(files) == 0 {
+		pomfError(w, http.StatusBadRequest, 0, "no files[] parts found")
+		return
+	}
+
+	commits := make([]pomfCommit, len(files))
+	errs := make([]error, len(files))
+
+	var wg sync.WaitGroup
+	for i, f := range files {
+		wg.Add(1)
+		go func(i int, f pomfFile) {
+			defer wg.Done()
+			c, err := commitPomfFile(r, f)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			commits[i] = c
+		}(i, f)
+	}
+	wg.Wait()
+
+	var failed error
+	for _, err := range errs {
+		if err != nil {
+			failed = err
+			break
+		}
+	}
+	if failed != nil {
+		// Commits ran concurrently, so undo every file in the batch whose
+		// commit succeeded, so a partial batch never leaves permanent,
+		// un-deletable, quota-counting blobs behind.
+		for i, err := range errs {
+			if err == nil {
+				rollbackPomfCommit(commits[i])
+			}
+		}
+		pomfError(w, http.StatusInsufficientStorage, 2, failed.Error())
+		return
+	}
+
+	results := make([]pomfFileResult, len(commits))
+	for i, c := range commits {
+		results[i] = c.result
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"success": true, "files": results})
+}
+
+// pomfCommit is commitPomfFile's internal result: the pomf-shaped entry to
+// hand back to the client, plus the id/delete_key needed to roll the claim
+// back if a sibling file in the same batch fails to commit.
+type pomfCommit struct {
+	result    pomfFileResult
+	id        string
+	deleteKey string
+}
+
+// commitPomfFile stores an already-hashed temp file under its content
+// address, the same way the canonical single-file endpoint does, and
+// returns the pomf-shaped result entry for it.
+func commitPomfFile(r *http.Request, f pomfFile) (pomfCommit, error) {
+	now := time.Now()
+	deleteKey, err := newDeleteKey()
+	if err != nil {
+		return pomfCommit{}, err
+	}
+	newClaim := claim{DeleteKey: deleteKey, UploadedAt: now.Unix()}
+
+	quotaMu.Lock()
+
+	exists, err := store.Exists(f.id)
+	if err != nil {
+		quotaMu.Unlock()
+		return pomfCommit{}, err
+	}
+	if exists {
+		sc, err := loadSidecar(f.id)
+		if err != nil {
+			quotaMu.Unlock()
+			return pomfCommit{}, err
+		}
+		sc.Claims = append(sc.Claims, newClaim)
+		err = saveSidecar(f.id, sc)
+		quotaMu.Unlock()
+		if err != nil {
+			return pomfCommit{}, err
+		}
+	} else {
+		used, err := store.Usage()
+		if err != nil {
+			quotaMu.Unlock()
+			return pomfCommit{}, err
+		}
+		if used+pendingBytes+f.size > cfg.MaxStorageByte {
+			quotaMu.Unlock()
+			return pomfCommit{}, errors.New("root storage limit exceeded")
+		}
+		pendingBytes += f.size
+		quotaMu.Unlock()
+
+		// store.Put (a real S3 network transfer when BACKEND=s3) runs without
+		// quotaMu held, same as the single-file and chunked-commit paths, so
+		// one file's commit doesn't serialize every other upload on the
+		// server — including its own batch siblings committing concurrently.
+		src, err := os.Open(f.tmpPath)
+		if err != nil {
+			quotaMu.Lock()
+			pendingBytes -= f.size
+			quotaMu.Unlock()
+			return pomfCommit{}, err
+		}
+		putErr := store.Put(f.id, src)
+		src.Close()
+
+		quotaMu.Lock()
+		pendingBytes -= f.size
+		if putErr != nil {
+			quotaMu.Unlock()
+			return pomfCommit{}, putErr
+		}
+
+		sc, err := loadSidecar(f.id)
+		if err != nil {
+			quotaMu.Unlock()
+			return pomfCommit{}, err
+		}
+		if sc.SHA256 == "" {
+			sc.SHA256 = f.sha256
+			sc.BLAKE3 = f.id
+			sc.Size = f.size
+			sc.Mimetype = f.mimetype
+		}
+		sc.Claims = append(sc.Claims, newClaim)
+		err = saveSidecar(f.id, sc)
+		quotaMu.Unlock()
+		if err != nil {
+			return pomfCommit{}, err
+		}
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+
+	return pomfCommit{
+		result: pomfFileResult{
+			URL:  scheme + "://" + r.Host + "/" + f.id,
+			Hash: f.sha256,
+			Size: f.size,
+			Name: f.name,
+		},
+		id:        f.id,
+		deleteKey: deleteKey,
+	}, nil
+}
+
+// rollbackPomfCommit undoes a successful commitPomfFile call after a
+// sibling file in the same batch failed, so partial batches never leave
+// permanent, un-deletable blobs counting against the storage quota.
+func rollbackPomfCommit(c pomfCommit) {
+	quotaMu.Lock()
+	_, err := removeClaim(c.id, c.deleteKey)
+	quotaMu.Unlock()
+	if err != nil {
+		log.Printf("pomf: rollback %s: %v", c.id, err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// s3Config holds the env-configured connection details for an S3-compatible
+// backend (AWS S3, MinIO, Cloudflare R2, Backblaze B2, Wasabi, ...).
+type s3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// s3Backend stores blobs as objects in a single bucket, keyed directly by
+// id. It trades the localfs backend's shard directories for whatever the
+// bucket's own key-space indexing does.
+type s3Backend struct {
+	client *s3.Client
+	bucket string
+}
+
+func newS3Backend(cfg s3Config) (*s3Backend, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 backend requires S3_BUCKET")
+	}
+
+	resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		if cfg.Endpoint == "" {
+			return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+		}
+		return aws.Endpoint{URL: cfg.Endpoint, SigningRegion: cfg.Region}, nil
+	})
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(),
+		awsconfig.WithRegion(cfg.Region),
+		awsconfig.WithEndpointResolverWithOptions(resolver),
+		awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(cfg.AccessKey, cfg.SecretKey, "")),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		o.UsePathStyle = cfg.Endpoint != ""
+	})
+
+	return &s3Backend{client: client, bucket: cfg.Bucket}, nil
+}
+
+func (b *s3Backend) Put(id string, r io.Reader) error {
+	uploader := manager.NewUploader(b.client)
+	_, err := uploader.Upload(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(id),
+		Body:   r,
+	})
+	return err
+}
+
+// Get returns an s3ObjectReader that fetches only the byte ranges actually
+// read from it (via ranged GetObject calls), rather than buffering the
+// whole object into memory — important since blobs here can be many GiB.
+// The HeadObject call below is metadata-only.
+func (b *s3Backend) Get(id string) (io.ReadSeeker, int64, time.Time, error) {
+	head, err := b.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(id),
+	})
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+
+	size := aws.ToInt64(head.ContentLength)
+	modTime := time.Now()
+	if head.LastModified != nil {
+		modTime = *head.LastModified
+	}
+	return &s3ObjectReader{client: b.client, bucket: b.bucket, key: id, size: size}, size, modTime, nil
+}
+
+// s3ObjectReader is a lazy io.ReadSeeker (and io.ReaderAt, for archive.go's
+// random-access zip reads) over a single S3 object: every Read/ReadAt issues
+// a ranged GetObject for just the bytes requested instead of holding the
+// object in memory.
+type s3ObjectReader struct {
+	client *s3.Client
+	bucket string
+	key    string
+	size   int64
+	offset int64
+}
+
+func (o *s3ObjectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p)) - 1
+	if end >= o.size {
+		end = o.size - 1
+	}
+
+	out, err := o.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(o.bucket),
+		Key:    aws.String(o.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, end)),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+
+	want := int(end-off) + 1
+	n, err := io.ReadFull(out.Body, p[:want])
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err == nil && end == o.size-1 {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *s3ObjectReader) Read(p []byte) (int, error) {
+	n, err := o.ReadAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = o.offset + offset
+	case io.SeekEnd:
+		newOffset = o.size + offset
+	default:
+		return 0, errors.New("s3ObjectReader: invalid whence")
+	}
+	if newOffset < 0 {
+		return 0, errors.New("s3ObjectReader: negative seek position")
+	}
+	o.offset = newOffset
+	return newOffset, nil
+}
+
+func (b *s3Backend) Exists(id string) (bool, error) {
+	_, err := b.client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(id),
+	})
+	if err != nil {
+		var nf *types.NotFound
+		if errors.As(err, &nf) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (b *s3Backend) Delete(id string) error {
+	_, err := b.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(id),
+	})
+	return err
+}
+
+// Usage sums blob object sizes in the bucket, excluding sidecar objects
+// (see sidecarKey) which don't count against the storage quota.
+func (b *s3Backend) Usage() (int64, error) {
+	var total int64
+	paginator := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.Background())
+		if err != nil {
+			return 0, err
+		}
+		for _, obj := range page.Contents {
+			if obj.Key != nil && strings.HasSuffix(*obj.Key, ".json") {
+				continue
+			}
+			if obj.Size != nil {
+				total += *obj.Size
+			}
+		}
+	}
+	return total, nil
+}
+
+// sidecarKey is the object key a blob's sidecar is stored under, alongside
+// the blob itself so every replica pointed at the bucket sees the same
+// delete keys, expiry, and mimetype.
+func (b *s3Backend) sidecarKey(id string) string {
+	return id + ".json"
+}
+
+func (b *s3Backend) PutSidecar(id string, data []byte) error {
+	_, err := b.client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.sidecarKey(id)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (b *s3Backend) GetSidecar(id string) ([]byte, error) {
+	out, err := b.client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.sidecarKey(id)),
+	})
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, ErrSidecarNotExist
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (b *s3Backend) DeleteSidecar(id string) error {
+	_, err := b.client.DeleteObject(context.Background(), &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.sidecarKey(id)),
+	})
+	return err
+}
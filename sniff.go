@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffHeaderSize mirrors http.DetectContentType's own read size; sniffers
+// in this file never need to look past it.
+const sniffHeaderSize = 512
+
+// extraMagic covers container formats http.DetectContentType doesn't know
+// about as of this Go version.
+var extraMagic = []struct {
+	offset int
+	magic  []byte
+	mime   string
+}{
+	{0, []byte{0x1A, 0x45, 0xDF, 0xA3}, "video/x-matroska"},          // Matroska/WebM EBML header
+	{0, []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}, "application/x-7z-compressed"},
+	{0, []byte{0x28, 0xB5, 0x2F, 0xFD}, "application/zstd"},
+}
+
+// sniffContentType inspects up to the first sniffHeaderSize bytes of a
+// blob and returns its detected MIME type, falling back to
+// http.DetectContentType for everything it doesn't special-case.
+func sniffContentType(header []byte) string {
+	for _, m := range extraMagic {
+		end := m.offset + len(m.magic)
+		if len(header) >= end && bytes.Equal(header[m.offset:end], m.magic) {
+			return m.mime
+		}
+	}
+	if len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WEBP" {
+		return "image/webp"
+	}
+	detected := http.DetectContentType(header)
+	if detected == "application/x-gzip" {
+		// http.DetectContentType's gzip magic-number match predates the IANA
+		// "application/gzip" type; normalize so sidecars and archiveMimeTypes
+		// (archive.go) only ever have to recognize one gzip spelling.
+		return "application/gzip"
+	}
+	return detected
+}
+
+// isForbidden reports whether detected (as returned by sniffContentType)
+// matches one of the configured FORBIDDEN_TYPES, ignoring any "; charset=…"
+// parameter suffix.
+func isForbidden(detected string, forbidden []string) bool {
+	if mt, _, err := mime.ParseMediaType(detected); err == nil {
+		detected = mt
+	}
+	for _, f := range forbidden {
+		if strings.EqualFold(detected, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerSniffer captures the first sniffHeaderSize bytes written to it and
+// discards the rest; meant to sit alongside the real destination writer(s)
+// in an io.MultiWriter so sniffing costs no extra read pass.
+type headerSniffer struct {
+	buf []byte
+}
+
+func (s *headerSniffer) Write(p []byte) (int, error) {
+	if len(s.buf) < sniffHeaderSize {
+		need := sniffHeaderSize - len(s.buf)
+		if need > len(p) {
+			need = len(p)
+		}
+		s.buf = append(s.buf, p[:need]...)
+	}
+	return len(p), nil
+}